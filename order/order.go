@@ -2,10 +2,14 @@ package order
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bakins/kubernetes-envoy-example/api/item"
@@ -20,9 +24,24 @@ import (
 	"github.com/hkwi/h2c"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/plugin/ochttp"
+	octracecontext "go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	octrace "go.opencensus.io/trace"
+	"go.opencensus.io/zpages"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
+// itemServiceName is the name health status is tracked and reported under
+// for the outbound item-service dependency.
+const itemServiceName = "item.ItemService"
+
 func init() {
 	grpc_prometheus.EnableHandlingTimeHistogram()
 }
@@ -33,17 +52,33 @@ type OptionsFunc func(*Server) error
 // Server is a wrapper for a simple front end HTTP server
 type Server struct {
 	address  string
+	network  string
+	listener net.Listener
 	endpoint string
 	server   *http.Server
 	grpc     *grpc.Server
 	store    *orderStore
 	item     item.ItemServiceClient
+	itemConn *grpc.ClientConn
+	health   *health.Server
+
+	tlsConfig   *tls.Config
+	clientCreds credentials.TransportCredentials
+
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	grpcServerOptions  []grpc.ServerOption
+	gatewayMuxOptions  []runtime.ServeMuxOption
+	dialOptions        []grpc.DialOption
+
+	traceExporters []octrace.Exporter
 }
 
 // New creates a new server
 func New(options ...OptionsFunc) (*Server, error) {
 	s := &Server{
 		address:  ":8080",
+		network:  "tcp",
 		endpoint: "127.0.0.1:9090",
 	}
 
@@ -53,11 +88,18 @@ func New(options ...OptionsFunc) (*Server, error) {
 		}
 	}
 
-	ctx := context.Background()
-	conn, err := grpc.DialContext(
-		ctx,
-		s.endpoint,
-		grpc.WithInsecure(),
+	for _, e := range s.traceExporters {
+		octrace.RegisterExporter(e)
+	}
+
+	transportCreds := grpc.WithInsecure()
+	if s.clientCreds != nil {
+		transportCreds = grpc.WithTransportCredentials(s.clientCreds)
+	}
+
+	dialOptions := append([]grpc.DialOption{
+		transportCreds,
+		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}),
 		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
 			util.UnaryClientInterceptor(),
 			grpc_prometheus.UnaryClientInterceptor,
@@ -65,19 +107,53 @@ func New(options ...OptionsFunc) (*Server, error) {
 		grpc.WithStreamInterceptor(grpc_middleware.ChainStreamClient(
 			grpc_prometheus.StreamClientInterceptor,
 		)),
-	)
+	}, s.dialOptions...)
+
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, s.endpoint, dialOptions...)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create grpc client")
 	}
+	s.itemConn = conn
 	s.item = item.NewItemServiceClient(conn)
 	s.store = newOrderStore(s, s.item)
 	// TODO: option to load this or not
 	s.store.LoadSampleData()
 
+	s.health = health.NewServer()
+	// The overall ("") status only ever reflects the item-service
+	// dependency below; orderStore currently exposes no health signal to
+	// factor in here.
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	go s.watchItemHealth()
+
 	return s, nil
 }
 
+// watchItemHealth keeps the item-service entry in the health tracker in
+// sync with the outbound connection's actual connectivity state, so both
+// grpc_health_probe and /healthz reflect a dependency that has gone
+// TRANSIENT_FAILURE instead of always reporting OK.
+func (s *Server) watchItemHealth() {
+	state := s.itemConn.GetState()
+	s.setItemHealth(state)
+
+	for s.itemConn.WaitForStateChange(context.Background(), state) {
+		state = s.itemConn.GetState()
+		s.setItemHealth(state)
+	}
+}
+
+func (s *Server) setItemHealth(state connectivity.State) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if state == connectivity.TransientFailure {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	s.health.SetServingStatus(itemServiceName, status)
+	s.health.SetServingStatus("", status)
+}
+
 // SetAddress sets the listening address.
 func SetAddress(address string) OptionsFunc {
 	return func(s *Server) error {
@@ -94,6 +170,131 @@ func SetEndpoint(address string) OptionsFunc {
 	}
 }
 
+// SetNetwork sets the network used when listening for connections, eg
+// "tcp" or "unix". It is ignored if SetListener is used. Defaults to "tcp".
+func SetNetwork(network string) OptionsFunc {
+	return func(s *Server) error {
+		s.network = network
+		return nil
+	}
+}
+
+// SetListener sets a pre-created listener for the server to use instead of
+// having Run dial one itself. This lets operators hand in a UNIX socket
+// shared with a sidecar such as Envoy.
+func SetListener(l net.Listener) OptionsFunc {
+	return func(s *Server) error {
+		s.listener = l
+		return nil
+	}
+}
+
+// WithUnaryInterceptor appends a unary server interceptor to the built-in
+// prometheus/zap/recovery/validator chain, rather than replacing it.
+func WithUnaryInterceptor(i grpc.UnaryServerInterceptor) OptionsFunc {
+	return func(s *Server) error {
+		s.unaryInterceptors = append(s.unaryInterceptors, i)
+		return nil
+	}
+}
+
+// WithStreamInterceptor appends a stream server interceptor to the stream
+// chain. Stream RPCs have no built-in interceptors, so that chain holds only
+// the interceptors given here.
+func WithStreamInterceptor(i grpc.StreamServerInterceptor) OptionsFunc {
+	return func(s *Server) error {
+		s.streamInterceptors = append(s.streamInterceptors, i)
+		return nil
+	}
+}
+
+// WithGRPCServerOptions appends extra grpc.ServerOptions, eg to raise
+// MaxRecvMsgSize, used when constructing the gRPC server in Run.
+func WithGRPCServerOptions(opts ...grpc.ServerOption) OptionsFunc {
+	return func(s *Server) error {
+		s.grpcServerOptions = append(s.grpcServerOptions, opts...)
+		return nil
+	}
+}
+
+// WithGatewayMuxOptions appends extra runtime.ServeMuxOptions used when
+// constructing the grpc-gateway mux in Run.
+func WithGatewayMuxOptions(opts ...runtime.ServeMuxOption) OptionsFunc {
+	return func(s *Server) error {
+		s.gatewayMuxOptions = append(s.gatewayMuxOptions, opts...)
+		return nil
+	}
+}
+
+// WithDialOptions appends extra grpc.DialOptions used when dialing the item
+// service, eg to add auth, tracing, or rate-limiting interceptors.
+func WithDialOptions(opts ...grpc.DialOption) OptionsFunc {
+	return func(s *Server) error {
+		s.dialOptions = append(s.dialOptions, opts...)
+		return nil
+	}
+}
+
+// WithTraceExporter registers a trace exporter (eg OTLP, Jaeger, Zipkin) so
+// spans covering the gateway->order->item hop are exported. It may be given
+// more than once to register multiple exporters.
+func WithTraceExporter(e octrace.Exporter) OptionsFunc {
+	return func(s *Server) error {
+		s.traceExporters = append(s.traceExporters, e)
+		return nil
+	}
+}
+
+// WithTLSConfig sets the TLS config used to terminate TLS on the front-end
+// listener. Run serves TLS whenever this or WithServerCertFiles is used.
+func WithTLSConfig(cfg *tls.Config) OptionsFunc {
+	return func(s *Server) error {
+		s.tlsConfig = cfg
+		return nil
+	}
+}
+
+// WithServerCertFiles loads a certificate/key pair and adds it to the
+// server's TLS config, creating one if none has been set yet.
+func WithServerCertFiles(certFile, keyFile string) OptionsFunc {
+	return func(s *Server) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not load server certificate")
+		}
+
+		if s.tlsConfig == nil {
+			s.tlsConfig = &tls.Config{}
+		}
+		s.tlsConfig.Certificates = append(s.tlsConfig.Certificates, cert)
+
+		return nil
+	}
+}
+
+// WithClientTransportCredentials sets the transport credentials used when
+// dialing the item service, eg to dial with mTLS instead of plaintext.
+func WithClientTransportCredentials(creds credentials.TransportCredentials) OptionsFunc {
+	return func(s *Server) error {
+		s.clientCreds = creds
+		return nil
+	}
+}
+
+// skipHealthAndReflection wraps a unary interceptor so it is bypassed for
+// grpc.health.v1.Health and grpc.reflection calls. The sleeper interceptor
+// it's used with here adds multi-second latency for test/demo purposes,
+// which would otherwise blow past grpc_health_probe's and Envoy's default
+// health-check timeouts and make the service look permanently unhealthy.
+func skipHealthAndReflection(interceptor grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") || strings.HasPrefix(info.FullMethod, "/grpc.reflection.") {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
 // Run starts the server. This generally does not return.
 func (s *Server) Run() error {
 	logger, err := util.NewDefaultLogger()
@@ -101,73 +302,192 @@ func (s *Server) Run() error {
 		return errors.Wrapf(err, "failed to create logger")
 	}
 
-	l, err := net.Listen("tcp", s.address)
-	if err != nil {
-		return errors.Wrapf(err, "failed to listen on %s", s.address)
+	l := s.listener
+	if l == nil {
+		l, err = net.Listen(s.network, s.address)
+		if err != nil {
+			return errors.Wrapf(err, "failed to listen on %s", s.address)
+		}
 	}
 
 	grpc_zap.ReplaceGrpcLogger(logger)
 	grpc_prometheus.EnableHandlingTimeHistogram()
 
-	s.grpc = grpc.NewServer(
-		grpc.UnaryInterceptor(
-			grpc_middleware.ChainUnaryServer(
-				util.UnaryServerInterceptor(),
-				util.UnaryServerSleeperInterceptor(time.Second*3),
-				grpc_validator.UnaryServerInterceptor(),
-				grpc_prometheus.UnaryServerInterceptor,
-				grpc_zap.UnaryServerInterceptor(logger),
-				grpc_recovery.UnaryServerInterceptor(),
-			),
-		),
-	)
-
-	gwmux := runtime.NewServeMux()
-	_, port, err := net.SplitHostPort(s.address)
+	unaryInterceptors := append([]grpc.UnaryServerInterceptor{
+		util.UnaryServerInterceptor(),
+		skipHealthAndReflection(util.UnaryServerSleeperInterceptor(time.Second * 3)),
+		grpc_validator.UnaryServerInterceptor(),
+		grpc_prometheus.UnaryServerInterceptor,
+		grpc_zap.UnaryServerInterceptor(logger),
+		grpc_recovery.UnaryServerInterceptor(),
+	}, s.unaryInterceptors...)
+
+	serverOptions := append([]grpc.ServerOption{
+		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(s.streamInterceptors...)),
+	}, s.grpcServerOptions...)
+
+	s.grpc = grpc.NewServer(serverOptions...)
+
+	gwmux := runtime.NewServeMux(s.gatewayMuxOptions...)
+	gatewayTarget, err := gatewayDialTarget(l)
 	if err != nil {
-		return errors.Wrapf(err, "invalid address %s", s.address)
+		return errors.Wrapf(err, "could not derive gateway dial target for %s", l.Addr())
+	}
+
+	gwTransportCreds := grpc.WithInsecure()
+	if s.tlsConfig != nil {
+		// The gateway dials the gRPC server over loopback (or the same UNIX
+		// socket), so it accepts the server's certificate without verifying
+		// it at all (neither its chain nor its hostname).
+		gwTLSConfig := &tls.Config{InsecureSkipVerify: true}
+		if s.tlsConfig.ClientAuth != tls.NoClientCert {
+			// The front-end requires client certs, ie mTLS. Present the
+			// server's own certificate back to itself for this loopback
+			// hop, since the gateway has no separate client identity.
+			gwTLSConfig.Certificates = s.tlsConfig.Certificates
+		}
+		gwTransportCreds = grpc.WithTransportCredentials(credentials.NewTLS(gwTLSConfig))
+	}
+	gwDialOptions := []grpc.DialOption{
+		gwTransportCreds,
+		// So the span started from the incoming traceparent header (see the
+		// ochttp.Handler wrapping gwmux below) continues into the order
+		// service's own gRPC server, and from there into the item client.
+		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}),
 	}
 
-	if err := order.RegisterOrderServiceHandlerFromEndpoint(context.Background(), gwmux, net.JoinHostPort("127.0.0.1", port), []grpc.DialOption{grpc.WithInsecure()}); err != nil {
+	if err := order.RegisterOrderServiceHandlerFromEndpoint(context.Background(), gwmux, gatewayTarget, gwDialOptions); err != nil {
 		return errors.Wrap(err, "failed to register grpc gateway")
 	}
 
 	order.RegisterOrderServiceServer(s.grpc, s.store)
+	healthpb.RegisterHealthServer(s.grpc, s.health)
+	reflection.Register(s.grpc)
+
+	// Decodes the incoming W3C traceparent header and starts a span with it
+	// as the remote parent, so gwmux's per-request context.Context (which
+	// grpc-gateway derives the gRPC call's context from) carries a real
+	// span that ocgrpc continues into order's gRPC server and the item
+	// client.
+	tracedGateway := &ochttp.Handler{
+		Handler:     gwmux,
+		Propagation: &octracecontext.HTTPFormat{},
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/healthz", healthz)
-	mux.Handle("/", gwmux)
+	mux.HandleFunc("/healthz", s.healthz)
+	zpages.Handle(mux, "/debug")
+	mux.Handle("/", tracedGateway)
+
+	muxHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 &&
+			strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
+			s.grpc.ServeHTTP(w, r)
+		} else {
+			mux.ServeHTTP(w, r)
+		}
+	})
+
+	// h2c is only needed to accept cleartext HTTP/2; a TLS listener
+	// negotiates HTTP/2 itself via ALPN.
+	var handler http.Handler = muxHandler
+	if s.tlsConfig == nil {
+		handler = h2c.Server{Handler: muxHandler}
+	}
 
 	s.server = &http.Server{
-		Handler: h2c.Server{
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.ProtoMajor == 2 &&
-					strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
-					s.grpc.ServeHTTP(w, r)
-				} else {
-					mux.ServeHTTP(w, r)
-				}
-			}),
-		},
-	}
-
-	if err := s.server.Serve(l); err != nil {
-		if err != http.ErrServerClosed {
-			return errors.Wrap(err, "failed to start http server")
+		Handler:   handler,
+		TLSConfig: s.tlsConfig,
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		if err := s.Stop(); err != nil {
+			logger.Error("failed to stop server cleanly", zap.Error(err))
 		}
+	}()
+
+	if s.tlsConfig != nil {
+		err = s.server.ServeTLS(l, "", "")
+	} else {
+		err = s.server.Serve(l)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "failed to start http server")
 	}
 
 	return nil
 }
 
-// Stop will stop the server
-func (s *Server) Stop() {
+// Stop drains in-flight HTTP/gRPC traffic before closing the outbound
+// item-service connection, so a Kubernetes preStop hook or a rolling
+// update doesn't drop orders mid-flight. s.grpc is served entirely through
+// s.server's h2c/TLS listener via ServeHTTP rather than its own Serve/
+// ServeTLS call, so s.server.Shutdown is what actually drains requests;
+// s.grpc.GracefulStop has no listener or connections of its own to drain.
+func (s *Server) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	s.server.Shutdown(ctx)
+
+	var err error
+	if s.server != nil {
+		if serr := s.server.Shutdown(ctx); serr != nil {
+			err = errors.Wrap(serr, "failed to shut down http server")
+		}
+	}
+
+	if s.itemConn != nil {
+		if cerr := s.itemConn.Close(); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "failed to close item service client connection")
+		}
+	}
+
+	return err
 }
 
-func healthz(wr http.ResponseWriter, r *http.Request) {
+// healthz reports non-200 when the item-service dependency is not SERVING,
+// so Envoy's health checker can drive traffic decisions instead of relying
+// on an always-"OK" response. It does not yet check orderStore health, as
+// orderStore currently exposes no signal to check.
+func (s *Server) healthz(wr http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{"", itemServiceName} {
+		resp, err := s.health.Check(r.Context(), &healthpb.HealthCheckRequest{Service: name})
+		if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+			http.Error(wr, "NOT OK\n", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	fmt.Fprintf(wr, "OK\n")
 }
+
+// gatewayDialTarget derives the grpc-gateway's dial target from the actual
+// listener in use. For a TCP listener this rejoins the listening port with
+// 127.0.0.1, as the gateway always talks to the gRPC server over loopback.
+// For a UNIX socket listener it returns a "unix://" target, or for an
+// abstract-namespace UNIX socket (whose Addr().String() is "@name") a
+// "unix-abstract:" target, so the gateway dials the same socket the gRPC
+// server is bound to.
+func gatewayDialTarget(l net.Listener) (string, error) {
+	addr := l.Addr()
+
+	if addr.Network() == "unix" {
+		if strings.HasPrefix(addr.String(), "@") {
+			return "unix-abstract:" + strings.TrimPrefix(addr.String(), "@"), nil
+		}
+		return "unix://" + addr.String(), nil
+	}
+
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid address %s", addr.String())
+	}
+
+	return net.JoinHostPort("127.0.0.1", port), nil
+}